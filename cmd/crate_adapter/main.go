@@ -0,0 +1,79 @@
+// Command crate_adapter implements a Prometheus remote read/write adapter
+// backed by Crate.io.
+package main
+
+import (
+	"context"
+	"flag"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/route"
+
+	"github.com/jodok/crate_adapter/pkg/cratedb"
+	"github.com/jodok/crate_adapter/pkg/queryapi"
+	"github.com/jodok/crate_adapter/pkg/remoteapi"
+)
+
+var (
+	listenAddress    = flag.String("web.listen-address", ":9268", "Address to listen on for Prometheus requests.")
+	crateURL         = flag.String("crate.url", "http://localhost:4200/_sql", "Comma-separated list of Crate node URLs to send SQL to.")
+	crateTimeout     = flag.Duration("crate.timeout", 10*time.Second, "Timeout for writes to Crate.")
+	crateReadTimeout = flag.Duration("crate.read-timeout", 30*time.Second, "Timeout for selects from Crate.")
+
+	crateMaxIdleConnsPerHost = flag.Int("crate.max-idle-conns-per-host", 10, "Max idle HTTP connections to keep open per Crate node.")
+	crateMaxConnsPerHost     = flag.Int("crate.max-conns-per-host", 0, "Max HTTP connections per Crate node, 0 for no limit.")
+	crateMaxRetries          = flag.Int("crate.max-retries", 2, "Max retries against another Crate node for a recoverable error.")
+
+	crateSchema     = flag.String("crate.schema", "", "Crate schema the metrics table lives in, empty for Crate's default schema.")
+	crateTable      = flag.String("crate.table", "metrics", "Base table to read from and write to.")
+	crateShardByDay = flag.Bool("crate.shard-by-day", false, "Write to and read from per-UTC-day \"<crate.table>_YYYYMMDD\" tables instead of crate.table directly, for easier retention management.")
+)
+
+func main() {
+	flag.Parse()
+
+	urls := strings.Split(*crateURL, ",")
+	for i, u := range urls {
+		urls[i] = strings.TrimSpace(u)
+	}
+
+	client := cratedb.NewClient(cratedb.Config{
+		URLs:                urls,
+		WriteTimeout:        *crateTimeout,
+		ReadTimeout:         *crateReadTimeout,
+		MaxIdleConnsPerHost: *crateMaxIdleConnsPerHost,
+		MaxConnsPerHost:     *crateMaxConnsPerHost,
+		MaxRetries:          *crateMaxRetries,
+		Schema:              *crateSchema,
+		Table:               *crateTable,
+		ShardByDay:          *crateShardByDay,
+	})
+	if err := client.EnsureSchema(context.Background()); err != nil {
+		log.With("err", err).Warn("Failed to prime Crate schema cache on startup; will fall back to discovering columns lazily on first write.")
+	}
+	srv := remoteapi.NewServer(client)
+	api := queryapi.NewAPI(client)
+
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<html>
+    <head><title>Crate.io Prometheus Adapter</title></head>
+    <body>
+    <h1>Crate.io Prometheus Adapter</h1>
+    </body>
+    </html>`))
+	})
+
+	http.HandleFunc("/write", srv.HandleWrite)
+	http.HandleFunc("/read", srv.HandleRead)
+	http.Handle("/metrics", promhttp.Handler())
+
+	apiRouter := route.New()
+	api.Register(apiRouter.WithPrefix("/api/v1"))
+	http.Handle("/api/v1/", apiRouter)
+	log.With("address", *listenAddress).Info("Listening")
+	log.Fatal(http.ListenAndServe(*listenAddress, nil))
+}
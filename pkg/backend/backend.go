@@ -0,0 +1,49 @@
+// Package backend defines the storage interface that pkg/remoteapi serves
+// the Prometheus remote read/write protocol on top of. Splitting it out
+// lets the HTTP plumbing in pkg/remoteapi be reused with a store other than
+// Crate, such as a mock for tests or a different time series database.
+package backend
+
+import (
+	"context"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// Backend is a storage engine that can answer a single remote-read query
+// and ingest remote-write samples.
+type Backend interface {
+	// Read runs query and returns the matching series.
+	Read(ctx context.Context, query *prompb.Query) ([]*prompb.TimeSeries, error)
+	// Write ingests every timeseries in req.
+	Write(ctx context.Context, req *prompb.WriteRequest) error
+}
+
+// RangePager is an optional capability a Backend may implement to serve a
+// query page by page in timestamp order instead of materializing the whole
+// result in memory, analogous to how http.Flusher is an optional capability
+// of http.ResponseWriter. Callers should type-assert for it and fall back
+// to Read if it is absent.
+type RangePager interface {
+	// ReadPage returns the rows for query with timestamp in
+	// (afterMs, query.EndTimestampMs], along with the latest timestamp
+	// seen so the caller can pass it back in as afterMs for the next page.
+	// Rows sharing a timestamp are never split across pages, so a page
+	// holds at most pageSize rows unless more than pageSize rows share a
+	// single timestamp, in which case that timestamp's rows are returned
+	// together. lastTimestampMs == afterMs signals there is nothing left
+	// to read.
+	ReadPage(ctx context.Context, query *prompb.Query, afterMs int64, pageSize int) (series []*prompb.TimeSeries, lastTimestampMs int64, err error)
+}
+
+// LabelQuerier is an optional capability a Backend may implement to answer
+// label-metadata queries (the /api/v1/labels and /api/v1/label/.../values
+// endpoints in pkg/queryapi) without scanning and aggregating samples.
+type LabelQuerier interface {
+	// LabelNames returns the sorted, distinct label names seen on samples
+	// with timestamp in [startMs, endMs].
+	LabelNames(ctx context.Context, startMs, endMs int64) ([]string, error)
+	// LabelValues returns the sorted, distinct values of label name seen
+	// on samples with timestamp in [startMs, endMs].
+	LabelValues(ctx context.Context, name string, startMs, endMs int64) ([]string, error)
+}
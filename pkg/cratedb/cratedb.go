@@ -0,0 +1,980 @@
+// Package cratedb implements backend.Backend on top of a Crate.io cluster,
+// translating Prometheus remote read/write requests into Crate SQL.
+package cratedb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+var (
+	writeCrateDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: "crate_adapter_write_crate_latency_seconds",
+		Help: "Latency for inserts to Crate.",
+	})
+	writeCrateErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "crate_adapter_write_crate_failed_total",
+		Help: "How many inserts to Crate failed.",
+	})
+	readCrateDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: "crate_adapter_read_crate_latency_seconds",
+		Help: "Latency for selects from Crate.",
+	})
+	readCrateErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "crate_adapter_read_crate_failed_total",
+		Help: "How many selects from Crate failed.",
+	})
+	crateRetries = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "crate_adapter_crate_retries_total",
+		Help: "How many times a request to Crate was retried after a recoverable error.",
+	})
+	crateNodeFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "crate_adapter_crate_node_failed_total",
+		Help: "How many requests to a given Crate node failed, by node.",
+	}, []string{"node"})
+)
+
+func init() {
+	prometheus.MustRegister(writeCrateDuration)
+	prometheus.MustRegister(writeCrateErrors)
+	prometheus.MustRegister(readCrateDuration)
+	prometheus.MustRegister(readCrateErrors)
+	prometheus.MustRegister(crateRetries)
+	prometheus.MustRegister(crateNodeFailures)
+}
+
+// Escaping for strings for Crate.io SQL.
+var escaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "'", "\\'")
+
+// escapeLabelName escapes a labelname for use in SQL as a column name.
+func escapeLabelName(s string) string {
+	return "\"l" + escaper.Replace(s) + "\""
+}
+
+// escapeLabelValue escapes a labelvalue for use in SQL as a string value.
+func escapeLabelValue(s string) string {
+	return "'" + escaper.Replace(s) + "'"
+}
+
+type crateRequest struct {
+	Stmt     string          `json:"stmt"`
+	BulkArgs [][]interface{} `json:"bulk_args,omitempty"`
+}
+
+type crateResponse struct {
+	Cols []string        `json:"cols,omitempty"`
+	Rows [][]interface{} `json:"rows,omitempty"`
+}
+
+// Config holds the tunables for a Client.
+type Config struct {
+	// URLs is the list of Crate node SQL endpoints to spread requests
+	// across round-robin, e.g. ["http://node1:4200/_sql",
+	// "http://node2:4200/_sql"].
+	URLs []string
+
+	// WriteTimeout bounds how long a single insert to Crate may run
+	// before its context is canceled.
+	WriteTimeout time.Duration
+	// ReadTimeout bounds how long a single select (or page of one) to
+	// Crate may run before its context is canceled.
+	ReadTimeout time.Duration
+
+	// MaxIdleConnsPerHost and MaxConnsPerHost tune the underlying
+	// http.Transport's connection pool towards each Crate node. Zero
+	// means use net/http's defaults.
+	MaxIdleConnsPerHost int
+	MaxConnsPerHost     int
+
+	// MaxRetries is how many additional attempts a recoverable failure
+	// (a network error, a 5xx, or a 429) gets before giving up.
+	MaxRetries int
+
+	// Schema is the Crate schema Table lives in, e.g. "doc". Empty means
+	// Crate's default schema for an unqualified table name.
+	Schema string
+	// Table is the base table metrics are read from and written to.
+	// Defaults to "metrics" if empty.
+	Table string
+	// ShardByDay routes writes to a per-UTC-day "<Table>_YYYYMMDD" table
+	// instead of Table directly, and reads as a UNION ALL across every
+	// shard a query's time range touches. This gives operators a
+	// retention story (drop a day's table wholesale) and a migration path
+	// to per-tenant tables, analogous to how Cortex and Thanos shard TSDB
+	// blocks by time range.
+	ShardByDay bool
+}
+
+// Client is a backend.Backend backed by a pool of Crate.io nodes.
+type Client struct {
+	HTTPClient   http.Client
+	WriteTimeout time.Duration
+	ReadTimeout  time.Duration
+	MaxRetries   int
+
+	nodes []string
+	next  uint32 // atomically incremented round-robin cursor
+
+	schema     string
+	table      string
+	shardByDay bool
+
+	// columnsMu guards columns, which caches the label columns already
+	// known to exist per table so ensureColumns only issues an ALTER
+	// TABLE once per label per table rather than on every write.
+	columnsMu sync.Mutex
+	columns   map[string]map[string]bool
+}
+
+// NewClient returns a Client built from cfg.
+func NewClient(cfg Config) *Client {
+	maxRetries := cfg.MaxRetries
+	if maxRetries < 0 {
+		maxRetries = 0
+	}
+	table := cfg.Table
+	if table == "" {
+		table = "metrics"
+	}
+	return &Client{
+		HTTPClient: http.Client{
+			Transport: &http.Transport{
+				MaxIdleConnsPerHost: cfg.MaxIdleConnsPerHost,
+				MaxConnsPerHost:     cfg.MaxConnsPerHost,
+			},
+		},
+		WriteTimeout: cfg.WriteTimeout,
+		ReadTimeout:  cfg.ReadTimeout,
+		MaxRetries:   maxRetries,
+		nodes:        cfg.URLs,
+		schema:       cfg.Schema,
+		table:        table,
+		shardByDay:   cfg.ShardByDay,
+		columns:      map[string]map[string]bool{},
+	}
+}
+
+// pickNode returns the next node to try, round-robin.
+func (c *Client) pickNode() string {
+	i := atomic.AddUint32(&c.next, 1)
+	return c.nodes[int(i)%len(c.nodes)]
+}
+
+// recoverableStatus reports whether an HTTP status code from Crate is
+// worth retrying against another node, mirroring how
+// prometheus/prometheus's remote.Client treats recoverableError: network
+// errors and 5xx/429 are transient, other 4xxs are the caller's fault.
+func recoverableStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= 500
+}
+
+// retryBackoff returns the delay before retry attempt n (0-indexed),
+// exponential with full jitter, capped at 2s.
+func retryBackoff(n int) time.Duration {
+	const base = 100 * time.Millisecond
+	const max = 2 * time.Second
+	d := base * time.Duration(1<<uint(n))
+	if d > max {
+		d = max
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// quoteIdent quotes s for use in SQL as an identifier (a table or schema
+// name), reusing the same escaping rules as label names and values since
+// Crate's identifier-quoting and string-quoting escapes agree on \ and ".
+func quoteIdent(s string) string {
+	return "\"" + escaper.Replace(s) + "\""
+}
+
+// tableIdent returns the quoted, schema-qualified identifier for table
+// name, e.g. "doc"."metrics_20260730".
+func (c *Client) tableIdent(name string) string {
+	if c.schema == "" {
+		return quoteIdent(name)
+	}
+	return quoteIdent(c.schema) + "." + quoteIdent(name)
+}
+
+// shardTableNames returns the underlying table(s) covering [startMs,
+// endMs]: the configured table if day-sharding is off, or one
+// "<table>_YYYYMMDD" shard per UTC day the range touches otherwise.
+func (c *Client) shardTableNames(startMs, endMs int64) []string {
+	if !c.shardByDay {
+		return []string{c.table}
+	}
+	start := time.Unix(0, startMs*int64(time.Millisecond)).UTC().Truncate(24 * time.Hour)
+	end := time.Unix(0, endMs*int64(time.Millisecond)).UTC().Truncate(24 * time.Hour)
+	var names []string
+	for d := start; !d.After(end); d = d.AddDate(0, 0, 1) {
+		names = append(names, c.table+"_"+d.Format("20060102"))
+	}
+	return names
+}
+
+// writeTable returns the destination table for a sample at tsMs: the
+// configured table, or its "<table>_YYYYMMDD" shard when day-sharding.
+func (c *Client) writeTable(tsMs int64) string {
+	if !c.shardByDay {
+		return c.table
+	}
+	day := time.Unix(0, tsMs*int64(time.Millisecond)).UTC().Format("20060102")
+	return c.table + "_" + day
+}
+
+// fromExpr returns the FROM-clause source for a read over [startMs,
+// endMs] together with the full set of label columns known across every
+// table it reads from: the table itself, or a UNION ALL across every
+// per-day shard it touches, analogous to how Cortex and Thanos query
+// across multiple TSDB blocks spanning a time range.
+//
+// Each shard can have accumulated a different set of label columns via
+// ensureColumns (a label that only ever appears on one day never gets
+// added to another day's table), so a plain "SELECT * ... UNION ALL
+// SELECT * ..." would fail or silently misalign columns the moment that
+// happens. Instead every branch explicitly selects the union of columns
+// across all shards, substituting NULL for the ones a given shard lacks.
+func (c *Client) fromExpr(ctx context.Context, startMs, endMs int64) (from string, labelCols []string, err error) {
+	tables := c.shardTableNames(startMs, endMs)
+
+	perTable := make([]map[string]bool, len(tables))
+	union := map[string]bool{}
+	for i, t := range tables {
+		cols, err := c.labelColumnsFor(ctx, t)
+		if err != nil {
+			return "", nil, err
+		}
+		perTable[i] = cols
+		for l := range cols {
+			union[l] = true
+		}
+	}
+	labelCols = make([]string, 0, len(union))
+	for l := range union {
+		labelCols = append(labelCols, l)
+	}
+	sort.Strings(labelCols)
+
+	if len(tables) == 1 {
+		return c.tableIdent(tables[0]), labelCols, nil
+	}
+
+	selects := make([]string, len(tables))
+	for i, t := range tables {
+		parts := make([]string, 0, len(labelCols)+3)
+		parts = append(parts, `"timestamp"`, `"value"`, `"valueRaw"`)
+		for _, l := range labelCols {
+			if perTable[i][l] {
+				parts = append(parts, escapeLabelName(l))
+			} else {
+				parts = append(parts, "NULL AS "+escapeLabelName(l))
+			}
+		}
+		selects[i] = "SELECT " + strings.Join(parts, ", ") + " FROM " + c.tableIdent(t)
+	}
+	return "(" + strings.Join(selects, " UNION ALL ") + ") AS " + quoteIdent(c.table), labelCols, nil
+}
+
+// labelColumnsFor returns the label columns known for table, sharing the
+// same cache ensureColumns populates on write so a hot table doesn't pay
+// for an information_schema round trip on every read. A table with no label
+// columns (including one that doesn't exist yet) is not cached, so
+// ensureTable still creates a day shard that a read touched first.
+func (c *Client) labelColumnsFor(ctx context.Context, table string) (map[string]bool, error) {
+	c.columnsMu.Lock()
+	known, cached := c.columns[table]
+	c.columnsMu.Unlock()
+	if cached {
+		cp := make(map[string]bool, len(known))
+		for l := range known {
+			cp[l] = true
+		}
+		return cp, nil
+	}
+
+	cols, err := c.existingLabelColumns(ctx, table)
+	if err != nil {
+		return nil, err
+	}
+	if len(cols) == 0 {
+		return cols, nil
+	}
+	c.columnsMu.Lock()
+	if c.columns[table] == nil {
+		c.columns[table] = map[string]bool{}
+	}
+	for l := range cols {
+		c.columns[table][l] = true
+	}
+	c.columnsMu.Unlock()
+	return cols, nil
+}
+
+// existingLabelColumns returns the label columns Crate already has for
+// table, by introspecting information_schema.columns.
+func (c *Client) existingLabelColumns(ctx context.Context, table string) (map[string]bool, error) {
+	stmt := fmt.Sprintf("SELECT column_name FROM information_schema.columns WHERE table_name = %s", escapeLabelValue(table))
+	if c.schema != "" {
+		stmt += fmt.Sprintf(" AND table_schema = %s", escapeLabelValue(c.schema))
+	}
+	data, err := c.post(ctx, stmt)
+	if err != nil {
+		return nil, err
+	}
+	cols := make(map[string]bool, len(data.Rows))
+	for _, row := range data.Rows {
+		if col, ok := row[0].(string); ok && len(col) > 1 && col[0] == 'l' {
+			cols[col[1:]] = true
+		}
+	}
+	return cols, nil
+}
+
+// ensureTable makes sure table exists, creating it with CREATE TABLE IF
+// NOT EXISTS when day-sharding is on. Without day-sharding, the
+// configured table is assumed to be pre-provisioned by an operator, as it
+// always has been; it's only day-sharding's per-day tables that would
+// otherwise need a human to create every new day's table by hand for
+// "automatic" sharding to actually be automatic. Cheap to call on every
+// write: once a table is known to exist in the shared columns cache, it
+// isn't touched again.
+func (c *Client) ensureTable(ctx context.Context, table string) error {
+	if !c.shardByDay {
+		return nil
+	}
+	c.columnsMu.Lock()
+	_, known := c.columns[table]
+	c.columnsMu.Unlock()
+	if known {
+		return nil
+	}
+	stmt := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s ("timestamp" TIMESTAMP, "value" STRING, "valueRaw" LONG)`, c.tableIdent(table))
+	_, err := c.post(ctx, stmt)
+	return err
+}
+
+// ensureColumns makes sure table has an "l<name>" column for every label
+// in labels, issuing ALTER TABLE ADD COLUMN for whichever ones aren't
+// already in the per-table cache. Concurrent writers racing to add the
+// same column is expected and tolerated, since Crate's "already exists"
+// error on that race isn't distinguishable from a caller mistake other
+// than by string-matching it.
+func (c *Client) ensureColumns(ctx context.Context, table string, labels []string) error {
+	c.columnsMu.Lock()
+	known := c.columns[table]
+	if known == nil {
+		known = map[string]bool{}
+		c.columns[table] = known
+	}
+	var missing []string
+	for _, l := range labels {
+		if !known[l] {
+			missing = append(missing, l)
+		}
+	}
+	c.columnsMu.Unlock()
+	if len(missing) == 0 {
+		return nil
+	}
+
+	existing, err := c.existingLabelColumns(ctx, table)
+	if err != nil {
+		return err
+	}
+	c.columnsMu.Lock()
+	for l := range existing {
+		known[l] = true
+	}
+	c.columnsMu.Unlock()
+
+	for _, l := range missing {
+		c.columnsMu.Lock()
+		has := known[l]
+		c.columnsMu.Unlock()
+		if has {
+			continue
+		}
+		stmt := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s STRING", c.tableIdent(table), escapeLabelName(l))
+		if _, err := c.post(ctx, stmt); err != nil && !strings.Contains(err.Error(), "already exists") {
+			return err
+		}
+		c.columnsMu.Lock()
+		known[l] = true
+		c.columnsMu.Unlock()
+	}
+	return nil
+}
+
+// EnsureSchema primes the known-columns cache for the configured table so
+// the first write doesn't pay for an information_schema round trip. It is
+// a best-effort optimization, not a requirement: callers that skip it (or
+// whose call fails because Crate isn't up yet) still get correct
+// behavior, just with a cache-priming introspection on the first write
+// instead of at startup. With day-sharding there is no single table to
+// prime — which shards exist isn't known upfront — so it's a no-op.
+func (c *Client) EnsureSchema(ctx context.Context) error {
+	if c.shardByDay {
+		return nil
+	}
+	cols, err := c.existingLabelColumns(ctx, c.table)
+	if err != nil {
+		return err
+	}
+	c.columnsMu.Lock()
+	defer c.columnsMu.Unlock()
+	if c.columns[c.table] == nil {
+		c.columns[c.table] = map[string]bool{}
+	}
+	for l := range cols {
+		c.columns[c.table][l] = true
+	}
+	return nil
+}
+
+// aggregatingFuncs maps the subset of PromQL functions carried in
+// query.Hints that we know how to push down as a Crate aggregate. Anything
+// else (including "rate", which isn't pushed down at all) falls back to
+// returning raw samples, which the engine then runs the real function over.
+//
+// query.Hints are purely advisory: promql/engine.go always re-applies the
+// hinted range function itself over whatever points Select returns, it never
+// trusts the pushdown to have already produced the final answer. That's fine
+// for "sum_over_time", "min_over_time" and "max_over_time" since those
+// operations are associative - re-running SUM/MIN/MAX over a set of
+// per-bucket SUMs/MINs/MAXes reproduces the same result as running it over
+// the raw samples directly. It is NOT fine for "avg_over_time" or
+// "count_over_time": re-averaging a set of per-bucket averages gives an
+// unweighted average-of-averages instead of the true average whenever
+// buckets have differing sample counts (the normal case), and re-counting
+// the per-bucket aggregate rows just yields the number of buckets in the
+// window rather than the real sample count. Both must stay off this list
+// until pushdown pushes down enough for the engine's own re-aggregation to
+// land on the right number, which this single-column-per-bucket shape can't
+// provide.
+var aggregatingFuncs = map[string]string{
+	"sum_over_time": "SUM",
+	"min_over_time": "MIN",
+	"max_over_time": "MAX",
+}
+
+// buildSelectSQL turns a read query into a Crate SQL query. When q.Hints
+// requests one of the aggregatingFuncs with a step, the aggregation is
+// pushed down into the SQL using a fixed-width timestamp bucket instead of
+// returning raw samples.
+func (c *Client) buildSelectSQL(ctx context.Context, q *prompb.Query) (string, error) {
+	selectors, err := matchersToSelectors(q.Matchers)
+	if err != nil {
+		return "", err
+	}
+	selectors = append(selectors, fmt.Sprintf("(timestamp <= %d)", q.EndTimestampMs))
+	selectors = append(selectors, fmt.Sprintf("(timestamp >= %d)", q.StartTimestampMs))
+	where := strings.Join(selectors, " AND ")
+	from, labelCols, err := c.fromExpr(ctx, q.StartTimestampMs, q.EndTimestampMs)
+	if err != nil {
+		return "", err
+	}
+
+	if sqlFunc, step, ok := pushdownAggregation(q); ok {
+		// Group by every label column known for the table, not just the
+		// ones pinned down by an equality matcher: a metric selector
+		// virtually always carries at least the __name__ EQ matcher, so
+		// grouping on a subset would silently merge distinct series that
+		// differ only in an unpinned label (e.g. "instance") into one
+		// summed row.
+		groupCols := make([]string, len(labelCols))
+		for i, l := range labelCols {
+			groupCols[i] = escapeLabelName(l)
+		}
+		bucket := fmt.Sprintf("(timestamp - (timestamp %% %d))", step)
+		// The aggregate CASTs the human-readable "value" column rather
+		// than reconstructing the float from the authoritative "valueRaw"
+		// bits, since Crate has no bit-reinterpret cast to undo
+		// math.Float64bits. That CAST fails (or produces garbage) on the
+		// "NaN"/"+Inf"/"-Inf" strings Write uses for stale markers and Inf
+		// samples, so those rows are excluded here rather than fed into
+		// it — matching how Prometheus' own range-vector functions
+		// already drop stale markers before *_over_time ever sees them.
+		aggWhere := where + ` AND "value" NOT IN ('NaN', '+Inf', '-Inf')`
+		selectCols := append(append([]string{}, groupCols...), bucket+" AS bucket", fmt.Sprintf("%s(CAST(\"value\" AS DOUBLE)) AS aggValue", sqlFunc))
+		groupBy := append(append([]string{}, groupCols...), "bucket")
+		return fmt.Sprintf(
+			"SELECT %s FROM %s WHERE %s GROUP BY %s ORDER BY bucket",
+			strings.Join(selectCols, ", "), from, aggWhere, strings.Join(groupBy, ", "),
+		), nil
+	}
+
+	return fmt.Sprintf("SELECT * FROM %s WHERE %s ORDER BY timestamp", from, where), nil
+}
+
+// pushdownAggregation reports whether q carries hints we can translate into
+// a Crate-side aggregate, and if so returns the SQL aggregate function and
+// the bucket width in milliseconds to group by.
+func pushdownAggregation(q *prompb.Query) (sqlFunc string, stepMs int64, ok bool) {
+	if q.Hints == nil || q.Hints.StepMs <= 0 {
+		return "", 0, false
+	}
+	sqlFunc, known := aggregatingFuncs[q.Hints.Func]
+	if !known {
+		return "", 0, false
+	}
+	return sqlFunc, q.Hints.StepMs, true
+}
+
+func matchersToSelectors(matchers []*prompb.LabelMatcher) ([]string, error) {
+	selectors := make([]string, 0, len(matchers))
+	for _, m := range matchers {
+		switch m.Type {
+		case prompb.LabelMatcher_EQ:
+			if m.Value == "" {
+				// Empty labels are recorded as NULL.
+				// In PromQL, empty labels and missing labels are the same thing.
+				selectors = append(selectors, fmt.Sprintf("(%s IS NULL)", escapeLabelName(m.Name)))
+			} else {
+				selectors = append(selectors, fmt.Sprintf("(%s = %s)", escapeLabelName(m.Name), escapeLabelValue(m.Value)))
+			}
+		case prompb.LabelMatcher_NEQ:
+			if m.Value == "" {
+				selectors = append(selectors, fmt.Sprintf("(%s IS NOT NULL)", escapeLabelName(m.Name)))
+			} else {
+				selectors = append(selectors, fmt.Sprintf("(%s != %s)", escapeLabelName(m.Name), escapeLabelValue(m.Value)))
+			}
+		case prompb.LabelMatcher_RE:
+			re := "^(?:" + m.Value + ")$"
+			matchesEmpty, err := regexp.MatchString(re, "")
+			if err != nil {
+				return nil, err
+			}
+			// Crate regexes are not RE2, so there may be small semantic differences here.
+			if matchesEmpty {
+				selectors = append(selectors, fmt.Sprintf("(%s ~ %s OR %s IS NULL)", escapeLabelName(m.Name), escapeLabelValue(re), escapeLabelName(m.Name)))
+			} else {
+				selectors = append(selectors, fmt.Sprintf("(%s ~ %s)", escapeLabelName(m.Name), escapeLabelValue(re)))
+			}
+		case prompb.LabelMatcher_NRE:
+			re := "^(?:" + m.Value + ")$"
+			matchesEmpty, err := regexp.MatchString(re, "")
+			if err != nil {
+				return nil, err
+			}
+			if matchesEmpty {
+				selectors = append(selectors, fmt.Sprintf("(%s !~ %s)", escapeLabelName(m.Name), escapeLabelValue(re)))
+			} else {
+				selectors = append(selectors, fmt.Sprintf("(%s !~ %s OR %s IS NULL)", escapeLabelName(m.Name), escapeLabelValue(re), escapeLabelName(m.Name)))
+			}
+		}
+	}
+	return selectors, nil
+}
+
+// rowsToTimeseries groups Crate rows by their label set, in the shape
+// "SELECT *" or the aggregate pushdown above returns them.
+func rowsToTimeseries(cols []string, rows [][]interface{}) []*prompb.TimeSeries {
+	timeseries := map[string]*prompb.TimeSeries{}
+	var order []string
+	for _, row := range rows {
+		labels := map[string]string{}
+		var v float64
+		var t int64
+		for i, value := range row {
+			column := cols[i]
+			switch {
+			case column[0] == 'l' && value != nil:
+				labels[column[1:]] = value.(string)
+			case column == "timestamp" || column == "bucket":
+				t, _ = value.(json.Number).Int64()
+			case column == "valueRaw":
+				val, _ := value.(json.Number).Int64()
+				v = math.Float64frombits(uint64(val))
+			case column == "aggValue":
+				v, _ = value.(json.Number).Float64()
+			}
+		}
+
+		names := make([]string, 0, len(labels))
+		for k := range labels {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		key := strings.Join(names, ",")
+		for _, n := range names {
+			key += "=" + labels[n]
+		}
+
+		ts, ok := timeseries[key]
+		if !ok {
+			ts = &prompb.TimeSeries{}
+			for _, n := range names {
+				ts.Labels = append(ts.Labels, prompb.Label{Name: n, Value: labels[n]})
+			}
+			timeseries[key] = ts
+			order = append(order, key)
+		}
+		ts.Samples = append(ts.Samples, prompb.Sample{Value: v, Timestamp: t})
+	}
+
+	resp := make([]*prompb.TimeSeries, 0, len(order))
+	for _, key := range order {
+		resp = append(resp, timeseries[key])
+	}
+	return resp
+}
+
+// Read implements backend.Backend.
+func (c *Client) Read(ctx context.Context, q *prompb.Query) ([]*prompb.TimeSeries, error) {
+	stmt, err := c.buildSelectSQL(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	data, err := c.post(ctx, stmt)
+	if err != nil {
+		return nil, err
+	}
+	return rowsToTimeseries(data.Cols, data.Rows), nil
+}
+
+// LabelNames implements backend.LabelQuerier by introspecting the table's
+// columns, since every label is stored as its own "l<name>" column. With
+// day-sharding this matches every "<table>_YYYYMMDD" shard by a LIKE
+// prefix rather than an exact name, since a label may have been added to
+// one shard's columns but not another's. startMs and endMs are not used:
+// every label column is returned, including ones with no samples in that
+// range.
+func (c *Client) LabelNames(ctx context.Context, startMs, endMs int64) ([]string, error) {
+	var match string
+	if c.shardByDay {
+		match = fmt.Sprintf("table_name LIKE %s", escapeLabelValue(c.table+"_%"))
+	} else {
+		match = fmt.Sprintf("table_name = %s", escapeLabelValue(c.table))
+	}
+	stmt := "SELECT DISTINCT column_name FROM information_schema.columns WHERE " + match
+	if c.schema != "" {
+		stmt += fmt.Sprintf(" AND table_schema = %s", escapeLabelValue(c.schema))
+	}
+	stmt += " ORDER BY column_name"
+	data, err := c.post(ctx, stmt)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(data.Rows))
+	for _, row := range data.Rows {
+		col, ok := row[0].(string)
+		if !ok || len(col) < 2 || col[0] != 'l' {
+			continue
+		}
+		names = append(names, col[1:])
+	}
+	return names, nil
+}
+
+// LabelValues implements backend.LabelQuerier.
+func (c *Client) LabelValues(ctx context.Context, name string, startMs, endMs int64) ([]string, error) {
+	from, _, err := c.fromExpr(ctx, startMs, endMs)
+	if err != nil {
+		return nil, err
+	}
+	stmt := fmt.Sprintf(
+		"SELECT DISTINCT %s FROM %s WHERE (timestamp >= %d) AND (timestamp <= %d) AND (%s IS NOT NULL) ORDER BY 1",
+		escapeLabelName(name), from, startMs, endMs, escapeLabelName(name),
+	)
+	data, err := c.post(ctx, stmt)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]string, 0, len(data.Rows))
+	for _, row := range data.Rows {
+		if v, ok := row[0].(string); ok {
+			values = append(values, v)
+		}
+	}
+	return values, nil
+}
+
+// ReadPage implements backend.RangePager, letting callers that care about
+// memory (namely the STREAMED_XOR_CHUNKS path in pkg/remoteapi) walk a
+// query's raw samples page by page instead of materializing the whole
+// result at once. It does not support hinted aggregation pushdown, since
+// that requires grouping across the whole range.
+func (c *Client) ReadPage(ctx context.Context, q *prompb.Query, afterMs int64, pageSize int) (series []*prompb.TimeSeries, lastTimestampMs int64, err error) {
+	selectors, err := matchersToSelectors(q.Matchers)
+	if err != nil {
+		return nil, 0, err
+	}
+	end := q.EndTimestampMs
+	pageSelectors := append(append([]string{}, selectors...),
+		fmt.Sprintf("(timestamp > %d)", afterMs),
+		fmt.Sprintf("(timestamp <= %d)", end),
+	)
+	from, _, err := c.fromExpr(ctx, afterMs, end)
+	if err != nil {
+		return nil, 0, err
+	}
+	// Over-fetch by one row so a page boundary landing in the middle of a
+	// group of same-timestamp rows (the norm: every scrape or remote-write
+	// batch stamps many series with the identical timestamp) can be detected,
+	// instead of silently losing whatever didn't make the cut once the next
+	// page starts at "timestamp > lastTimestampMs".
+	stmt := fmt.Sprintf("SELECT * FROM %s WHERE %s ORDER BY timestamp LIMIT %d", from, strings.Join(pageSelectors, " AND "), pageSize+1)
+
+	data, err := c.post(ctx, stmt)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(data.Rows) == 0 {
+		return nil, afterMs, nil
+	}
+
+	tsCol := -1
+	for i, col := range data.Cols {
+		if col == "timestamp" {
+			tsCol = i
+			break
+		}
+	}
+	timestampOf := func(row []interface{}) int64 {
+		if n, ok := row[tsCol].(json.Number); ok {
+			if v, err := n.Int64(); err == nil {
+				return v
+			}
+		}
+		return 0
+	}
+
+	rows := data.Rows
+	if len(rows) <= pageSize {
+		return rowsToTimeseries(data.Cols, rows), timestampOf(rows[len(rows)-1]), nil
+	}
+
+	// rows has pageSize+1 entries; rows[pageSize] is the lookahead row beyond
+	// the page. Trim back to the last row whose timestamp differs from it, so
+	// every row sharing that timestamp is held back whole for the next page.
+	boundary := timestampOf(rows[pageSize])
+	cut := pageSize
+	for cut > 0 && timestampOf(rows[cut-1]) == boundary {
+		cut--
+	}
+	if cut == 0 {
+		// The entire page shares a single timestamp: trimming would return an
+		// empty page and never make progress. Fetch that whole instant
+		// directly instead of splitting it across pages.
+		instantSelectors := append(append([]string{}, selectors...), fmt.Sprintf("(timestamp = %d)", boundary))
+		stmt := fmt.Sprintf("SELECT * FROM %s WHERE %s", from, strings.Join(instantSelectors, " AND "))
+		data, err := c.post(ctx, stmt)
+		if err != nil {
+			return nil, 0, err
+		}
+		return rowsToTimeseries(data.Cols, data.Rows), boundary, nil
+	}
+	rows = rows[:cut]
+	return rowsToTimeseries(data.Cols, rows), timestampOf(rows[len(rows)-1]), nil
+}
+
+// Write implements backend.Backend. With day-sharding, a single write
+// request can span multiple destination tables, so it groups samples by
+// shard and issues one bulk INSERT per shard touched, priming each
+// shard's label columns first.
+func (c *Client) Write(ctx context.Context, req *prompb.WriteRequest) error {
+	if c.WriteTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.WriteTimeout)
+		defer cancel()
+	}
+
+	labels, bulkArgsByTable := c.groupWritesByTable(req)
+	for table, bulkArgs := range bulkArgsByTable {
+		if err := c.ensureTable(ctx, table); err != nil {
+			return err
+		}
+		if err := c.ensureColumns(ctx, table, labels); err != nil {
+			return err
+		}
+
+		request := buildInsertSQL(c.tableIdent(table), labels, bulkArgs)
+		jsonRequest, err := json.Marshal(request)
+		if err != nil {
+			return err
+		}
+		log.With("json", string(jsonRequest)).Debug("Insert to Crate")
+
+		timer := prometheus.NewTimer(writeCrateDuration)
+		resp, err := c.doPost(ctx, jsonRequest)
+		timer.ObserveDuration()
+		if err != nil {
+			writeCrateErrors.Inc()
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			writeCrateErrors.Inc()
+			respBody, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			log.With("body", respBody).Error("Crate did not report success on insert.")
+			return fmt.Errorf("Crate did not report success on insert (status %s)", resp.Status)
+		}
+		resp.Body.Close()
+	}
+	return nil
+}
+
+// groupWritesByTable returns the sorted label names used across req (every
+// destination table shares this column set) and, for each sample, the
+// bulk-args row it contributes to its destination table's INSERT.
+func (c *Client) groupWritesByTable(req *prompb.WriteRequest) (labels []string, bulkArgsByTable map[string][][]interface{}) {
+	labelsUsed := map[string]struct{}{}
+	for _, ts := range req.Timeseries {
+		for _, l := range ts.Labels {
+			labelsUsed[l.Name] = struct{}{}
+		}
+	}
+	labels = make([]string, 0, len(labelsUsed))
+	for l := range labelsUsed {
+		labels = append(labels, l)
+	}
+	sort.Strings(labels)
+
+	bulkArgsByTable = map[string][][]interface{}{}
+	for _, ts := range req.Timeseries {
+		metric := make(map[string]string, len(ts.Labels))
+		for _, l := range ts.Labels {
+			metric[l.Name] = l.Value
+		}
+
+		for _, s := range ts.Samples {
+			args := make([]interface{}, 0, len(labels)+3)
+			for _, l := range labels {
+				if metric[l] == "" {
+					args = append(args, nil)
+				} else {
+					args = append(args, metric[l])
+				}
+			}
+			// Convert to string to handle NaN/Inf/-Inf
+			args = append(args, fmt.Sprintf("%f", s.Value))
+			// Crate.io can't handle full NaN values as required by Prometheus 2.0,
+			// so store the raw bits as an int64.
+			args = append(args, int64(math.Float64bits(s.Value)))
+			args = append(args, s.Timestamp)
+
+			table := c.writeTable(s.Timestamp)
+			bulkArgsByTable[table] = append(bulkArgsByTable[table], args)
+		}
+	}
+	return labels, bulkArgsByTable
+}
+
+// buildInsertSQL turns a group of same-table bulk-args rows into a single
+// bulk-args INSERT against tableIdent (as returned by Client.tableIdent).
+func buildInsertSQL(tableIdent string, labels []string, bulkArgs [][]interface{}) *crateRequest {
+	escapedLabels := make([]string, len(labels))
+	for i, l := range labels {
+		escapedLabels[i] = escapeLabelName(l)
+	}
+	placeholders := strings.Repeat("?, ", len(labels))
+	columns := strings.Join(escapedLabels, ", ")
+	return &crateRequest{
+		Stmt:     fmt.Sprintf("INSERT INTO %s (%s, \"value\", \"valueRaw\", \"timestamp\") VALUES (%s ?, ?, ?)", tableIdent, columns, placeholders),
+		BulkArgs: bulkArgs,
+	}
+}
+
+// post runs stmt against Crate and decodes the response.
+func (c *Client) post(ctx context.Context, stmt string) (*crateResponse, error) {
+	if c.ReadTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.ReadTimeout)
+		defer cancel()
+	}
+
+	request := crateRequest{Stmt: stmt}
+	jsonRequest, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	log.With("json", string(jsonRequest)).Debug("Select from Crate")
+
+	timer := prometheus.NewTimer(readCrateDuration)
+	result, err := c.doPost(ctx, jsonRequest)
+	timer.ObserveDuration()
+	if err != nil {
+		readCrateErrors.Inc()
+		return nil, err
+	}
+	defer result.Body.Close()
+	if result.StatusCode != http.StatusOK {
+		readCrateErrors.Inc()
+		respBody, _ := ioutil.ReadAll(result.Body)
+		return nil, fmt.Errorf("Crate returned HTTP status %s: %s", result.Status, respBody)
+	}
+	var data crateResponse
+	decoder := json.NewDecoder(result.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&data); err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
+
+// doPost sends an already-marshaled Crate request body.
+// doPost sends body to a Crate node, retrying recoverable failures
+// (network errors, 5xx, 429) against other nodes in the pool with
+// exponential backoff and jitter. Permanent 4xx failures are returned
+// immediately without retrying.
+func (c *Client) doPost(ctx context.Context, body []byte) (*http.Response, error) {
+	var lastErr error
+	for attempt := 0; attempt <= c.MaxRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(retryBackoff(attempt - 1)):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+
+		node := c.pickNode()
+		req, err := http.NewRequest(http.MethodPost, node, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := c.HTTPClient.Do(req)
+		if err != nil {
+			lastErr = err
+			crateNodeFailures.WithLabelValues(node).Inc()
+			if attempt < c.MaxRetries {
+				crateRetries.Inc()
+				continue
+			}
+			return nil, lastErr
+		}
+
+		if recoverableStatus(resp.StatusCode) {
+			resp.Body.Close()
+			crateNodeFailures.WithLabelValues(node).Inc()
+			lastErr = fmt.Errorf("Crate node %s returned HTTP status %s", node, resp.Status)
+			if attempt < c.MaxRetries {
+				crateRetries.Inc()
+				continue
+			}
+			return nil, lastErr
+		}
+
+		return resp, nil
+	}
+	return nil, lastErr
+}
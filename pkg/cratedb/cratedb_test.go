@@ -0,0 +1,229 @@
+package cratedb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// newTestClient returns a Client wired to a single fake node, with its
+// known-columns cache pre-populated so reads never need a real
+// information_schema round trip.
+func newTestClient(t *testing.T, table string, columnsByTable map[string][]string) *Client {
+	t.Helper()
+	c := NewClient(Config{URLs: []string{"http://crate.invalid/_sql"}, Table: table})
+	for tbl, cols := range columnsByTable {
+		c.columns[tbl] = map[string]bool{}
+		for _, col := range cols {
+			c.columns[tbl][col] = true
+		}
+	}
+	return c
+}
+
+func TestPushdownAggregationOnlyAssociativeFuncs(t *testing.T) {
+	cases := []struct {
+		fn      string
+		wantSQL string
+		wantOK  bool
+	}{
+		{"sum_over_time", "SUM", true},
+		{"min_over_time", "MIN", true},
+		{"max_over_time", "MAX", true},
+		// avg_over_time and count_over_time must NOT be pushed down: the
+		// engine always re-applies the hinted function over whatever points
+		// Select returns, and re-averaging per-bucket averages (or
+		// re-counting per-bucket aggregate rows) doesn't reproduce the true
+		// avg_over_time/count_over_time result.
+		{"avg_over_time", "", false},
+		{"count_over_time", "", false},
+		{"rate", "", false},
+	}
+	for _, tc := range cases {
+		q := &prompb.Query{Hints: &prompb.ReadHints{StepMs: 15000, Func: tc.fn}}
+		sqlFunc, step, ok := pushdownAggregation(q)
+		if ok != tc.wantOK {
+			t.Errorf("pushdownAggregation(%s): ok = %v, want %v", tc.fn, ok, tc.wantOK)
+			continue
+		}
+		if ok && (sqlFunc != tc.wantSQL || step != 15000) {
+			t.Errorf("pushdownAggregation(%s) = (%s, %d), want (%s, 15000)", tc.fn, sqlFunc, step, tc.wantSQL)
+		}
+	}
+}
+
+func TestBuildSelectSQLShapes(t *testing.T) {
+	c := newTestClient(t, "metrics", map[string][]string{"metrics": {"__name__", "instance"}})
+	matchers := []*prompb.LabelMatcher{
+		{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"},
+	}
+
+	raw, err := c.buildSelectSQL(context.Background(), &prompb.Query{
+		StartTimestampMs: 1000, EndTimestampMs: 2000, Matchers: matchers,
+	})
+	if err != nil {
+		t.Fatalf("raw query: %v", err)
+	}
+	if !strings.HasPrefix(raw, "SELECT * FROM ") || strings.Contains(raw, "GROUP BY") {
+		t.Errorf("expected a raw-sample SELECT * with no GROUP BY, got: %s", raw)
+	}
+
+	pushed, err := c.buildSelectSQL(context.Background(), &prompb.Query{
+		StartTimestampMs: 1000, EndTimestampMs: 2000, Matchers: matchers,
+		Hints: &prompb.ReadHints{StepMs: 15000, Func: "sum_over_time"},
+	})
+	if err != nil {
+		t.Fatalf("pushdown query: %v", err)
+	}
+	if !strings.Contains(pushed, "SUM(CAST(\"value\" AS DOUBLE)) AS aggValue") {
+		t.Errorf("expected a SUM(CAST(\"value\"...)) aggregate, got: %s", pushed)
+	}
+	if !strings.Contains(pushed, `GROUP BY "l__name__", "linstance", bucket`) {
+		t.Errorf("expected GROUP BY over every known label column plus bucket, got: %s", pushed)
+	}
+	if !strings.Contains(pushed, `"value" NOT IN ('NaN', '+Inf', '-Inf')`) {
+		t.Errorf("expected non-finite values excluded from the aggregate, got: %s", pushed)
+	}
+
+	notPushed, err := c.buildSelectSQL(context.Background(), &prompb.Query{
+		StartTimestampMs: 1000, EndTimestampMs: 2000, Matchers: matchers,
+		Hints: &prompb.ReadHints{StepMs: 15000, Func: "avg_over_time"},
+	})
+	if err != nil {
+		t.Fatalf("avg_over_time query: %v", err)
+	}
+	if !strings.HasPrefix(notPushed, "SELECT * FROM ") || strings.Contains(notPushed, "GROUP BY") {
+		t.Errorf("avg_over_time must fall back to raw samples, got: %s", notPushed)
+	}
+}
+
+func TestFromExprUnionAllAlignsDivergentShardColumns(t *testing.T) {
+	c := newTestClient(t, "metrics", map[string][]string{
+		"metrics_20260101": {"__name__", "instance"},
+		"metrics_20260102": {"__name__", "region"},
+	})
+	c.shardByDay = true
+
+	startMs := int64(1767225600000) // 2026-01-01T00:00:00Z
+	endMs := int64(1767312000000)   // 2026-01-02T00:00:00Z
+
+	from, labelCols, err := c.fromExpr(context.Background(), startMs, endMs)
+	if err != nil {
+		t.Fatalf("fromExpr: %v", err)
+	}
+	wantCols := []string{"__name__", "instance", "region"}
+	sort.Strings(labelCols)
+	if !reflect.DeepEqual(labelCols, wantCols) {
+		t.Fatalf("labelCols = %v, want %v", labelCols, wantCols)
+	}
+	if !strings.Contains(from, "UNION ALL") {
+		t.Fatalf("expected a UNION ALL across shards, got: %s", from)
+	}
+	// The shard missing "region" must substitute NULL rather than omitting
+	// the column, so every branch of the UNION ALL has the same shape.
+	if !strings.Contains(from, `NULL AS "lregion"`) {
+		t.Errorf("expected metrics_20260101's SELECT to NULL out the missing \"region\" column, got: %s", from)
+	}
+	if !strings.Contains(from, `NULL AS "linstance"`) {
+		t.Errorf("expected metrics_20260102's SELECT to NULL out the missing \"instance\" column, got: %s", from)
+	}
+}
+
+// fakeCrateServer responds to a Crate SQL POST with rows built from a
+// caller-supplied set of (timestamp, valueRaw) pairs, mimicking the shape
+// ReadPage's "SELECT * ... ORDER BY timestamp LIMIT n" query expects back.
+// A statement carrying a "(timestamp = N)" selector (ReadPage's whole-instant
+// fetch) only gets the points at N; any other statement gets every point.
+func fakeCrateServer(t *testing.T, points [][2]int64) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req crateRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decode fake Crate request: %v", err)
+		}
+		var instant int64
+		hasInstant := false
+		if i := strings.Index(req.Stmt, "(timestamp = "); i >= 0 {
+			_, err := fmt.Sscanf(req.Stmt[i:], "(timestamp = %d)", &instant)
+			hasInstant = err == nil
+		}
+		rows := make([][]interface{}, 0, len(points))
+		for _, p := range points {
+			if hasInstant && p[0] != instant {
+				continue
+			}
+			rows = append(rows, []interface{}{p[0], "1", p[1]})
+		}
+		resp := crateResponse{Cols: []string{"timestamp", "value", "valueRaw"}, Rows: rows}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			t.Fatalf("encode fake Crate response: %v", err)
+		}
+	}))
+}
+
+func bitsOf(v float64) int64 {
+	return int64(math.Float64bits(v))
+}
+
+func TestReadPageKeepsSameTimestampGroupsWhole(t *testing.T) {
+	// Five rows share timestamp 100, pageSize is 3: the naive "ORDER BY
+	// timestamp LIMIT pageSize" would split that group across two pages and
+	// permanently lose the rows that didn't make the cut, since the next
+	// page starts at "timestamp > 100". ReadPage must hold the whole group
+	// back instead.
+	points := [][2]int64{
+		{100, bitsOf(1)}, {100, bitsOf(2)}, {100, bitsOf(3)}, {100, bitsOf(4)}, {100, bitsOf(5)},
+		{200, bitsOf(6)},
+	}
+	srv := fakeCrateServer(t, points)
+	defer srv.Close()
+
+	c := NewClient(Config{URLs: []string{srv.URL}, Table: "metrics"})
+	c.columns["metrics"] = map[string]bool{}
+
+	series, lastMs, err := c.ReadPage(context.Background(), &prompb.Query{EndTimestampMs: 1000}, 0, 3)
+	if err != nil {
+		t.Fatalf("ReadPage: %v", err)
+	}
+	if lastMs != 100 {
+		t.Errorf("lastTimestampMs = %d, want 100 (the shared timestamp, returned whole so the next page starts after it)", lastMs)
+	}
+	if got := len(series[0].Samples); got != 5 {
+		t.Errorf("got %d samples on the first page, want all 5 same-timestamp rows held together", got)
+	}
+}
+
+func TestReadPageTrimsIncompleteTrailingGroup(t *testing.T) {
+	// pageSize 3 over-fetches 4 rows; the 4th (lookahead) row shares its
+	// timestamp with the 3rd, so the page must be trimmed back to the last
+	// row whose timestamp actually changes (just the first one here).
+	points := [][2]int64{
+		{100, bitsOf(1)}, {200, bitsOf(2)}, {200, bitsOf(3)}, {200, bitsOf(4)},
+	}
+	srv := fakeCrateServer(t, points)
+	defer srv.Close()
+
+	c := NewClient(Config{URLs: []string{srv.URL}, Table: "metrics"})
+	c.columns["metrics"] = map[string]bool{}
+
+	series, lastMs, err := c.ReadPage(context.Background(), &prompb.Query{EndTimestampMs: 1000}, 0, 3)
+	if err != nil {
+		t.Fatalf("ReadPage: %v", err)
+	}
+	if lastMs != 100 {
+		t.Errorf("lastTimestampMs = %d, want 100 (the last fully-resolved timestamp)", lastMs)
+	}
+	if got := len(series[0].Samples); got != 1 {
+		t.Errorf("got %d samples, want only the timestamp-100 row; the incomplete timestamp-200 group must wait for the next page", got)
+	}
+}
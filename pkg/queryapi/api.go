@@ -0,0 +1,302 @@
+// Package queryapi implements the Prometheus HTTP query API
+// (/api/v1/query, /api/v1/query_range, /api/v1/series, /api/v1/labels,
+// /api/v1/label/<name>/values) on top of a backend.Backend, so Grafana (or
+// any other Prometheus API client) can talk to the adapter directly instead
+// of round-tripping through a Prometheus server. Response shapes follow
+// github.com/prometheus/client_golang/api/prometheus/v1.
+package queryapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/common/route"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
+
+	"github.com/jodok/crate_adapter/pkg/backend"
+)
+
+// defaultQueryTimeout bounds how long a single PromQL evaluation may run.
+const defaultQueryTimeout = 2 * time.Minute
+
+// defaultMaxSamples bounds how many samples a single PromQL evaluation may
+// load into memory at once.
+const defaultMaxSamples = 50000000
+
+// API serves the Prometheus HTTP query API on top of a Backend.
+type API struct {
+	engine    *promql.Engine
+	queryable *queryable
+}
+
+// NewAPI returns an API querying b.
+func NewAPI(b backend.Backend) *API {
+	return &API{
+		engine: promql.NewEngine(promql.EngineOpts{
+			MaxSamples: defaultMaxSamples,
+			Timeout:    defaultQueryTimeout,
+		}),
+		queryable: &queryable{backend: b},
+	}
+}
+
+// Register adds the API's routes to r, typically a router made with
+// WithPrefix("/api/v1").
+func (a *API) Register(r *route.Router) {
+	r.Get("/query", a.handleQuery)
+	r.Post("/query", a.handleQuery)
+	r.Get("/query_range", a.handleQueryRange)
+	r.Post("/query_range", a.handleQueryRange)
+	r.Get("/series", a.handleSeries)
+	r.Get("/labels", a.handleLabels)
+	r.Get("/label/:name/values", a.handleLabelValues)
+}
+
+type apiResponse struct {
+	Status    string      `json:"status"`
+	Data      interface{} `json:"data,omitempty"`
+	ErrorType string      `json:"errorType,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+func respondSuccess(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	writeJSON(w, http.StatusOK, apiResponse{Status: "success", Data: data})
+}
+
+func respondError(w http.ResponseWriter, status int, errType, msg string) {
+	log.With("errorType", errType).With("err", msg).Error("Query API request failed.")
+	w.Header().Set("Content-Type", "application/json")
+	writeJSON(w, status, apiResponse{Status: "error", ErrorType: errType, Error: msg})
+}
+
+func writeJSON(w http.ResponseWriter, status int, resp apiResponse) {
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.With("err", err).Error("Failed to encode query API response.")
+	}
+}
+
+// queryResultData wraps a promql.Value in the {resultType, result} shape
+// api/prometheus/v1 expects; promql.Vector/Matrix/Scalar/String already
+// marshal their "result" field in the matching format.
+func queryResultData(v promql.Value) interface{} {
+	return struct {
+		ResultType string       `json:"resultType"`
+		Result     promql.Value `json:"result"`
+	}{
+		ResultType: string(v.Type()),
+		Result:     v,
+	}
+}
+
+func (a *API) handleQuery(w http.ResponseWriter, r *http.Request) {
+	ts, err := parseTimeParam(r.FormValue("time"), time.Now())
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "bad_data", err.Error())
+		return
+	}
+
+	qry, err := a.engine.NewInstantQuery(a.queryable, r.FormValue("query"), ts)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "bad_data", err.Error())
+		return
+	}
+	defer qry.Close()
+
+	res := qry.Exec(r.Context())
+	if res.Err != nil {
+		respondError(w, http.StatusUnprocessableEntity, "exec", res.Err.Error())
+		return
+	}
+	respondSuccess(w, queryResultData(res.Value))
+}
+
+func (a *API) handleQueryRange(w http.ResponseWriter, r *http.Request) {
+	start, err := parseTimeParam(r.FormValue("start"), time.Time{})
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "bad_data", "invalid start: "+err.Error())
+		return
+	}
+	end, err := parseTimeParam(r.FormValue("end"), time.Time{})
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "bad_data", "invalid end: "+err.Error())
+		return
+	}
+	step, err := parseDuration(r.FormValue("step"))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "bad_data", "invalid step: "+err.Error())
+		return
+	}
+	if end.Before(start) {
+		respondError(w, http.StatusBadRequest, "bad_data", "end before start")
+		return
+	}
+	if step <= 0 {
+		respondError(w, http.StatusBadRequest, "bad_data", "step must be > 0")
+		return
+	}
+
+	qry, err := a.engine.NewRangeQuery(a.queryable, r.FormValue("query"), start, end, step)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "bad_data", err.Error())
+		return
+	}
+	defer qry.Close()
+
+	res := qry.Exec(r.Context())
+	if res.Err != nil {
+		respondError(w, http.StatusUnprocessableEntity, "exec", res.Err.Error())
+		return
+	}
+	respondSuccess(w, queryResultData(res.Value))
+}
+
+// handleSeries answers /api/v1/series by running each match[] selector as
+// a Select over [start, end] against the queryable and returning the
+// distinct label sets found. The backend still reads the samples; only
+// their values are left out of the response.
+func (a *API) handleSeries(w http.ResponseWriter, r *http.Request) {
+	start, err := parseTimeParam(r.FormValue("start"), time.Now().Add(-1*time.Hour))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "bad_data", err.Error())
+		return
+	}
+	end, err := parseTimeParam(r.FormValue("end"), time.Now())
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "bad_data", err.Error())
+		return
+	}
+
+	matcherSets, err := parseMatchParams(r.Form["match[]"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "bad_data", err.Error())
+		return
+	}
+
+	querier, err := a.queryable.Querier(r.Context(), timeToMs(start), timeToMs(end))
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "internal", err.Error())
+		return
+	}
+	defer querier.Close()
+
+	seen := map[string]model.Metric{}
+	for _, matchers := range matcherSets {
+		set := querier.Select(false, nil, matchers...)
+		for set.Next() {
+			m := set.At()
+			metric := make(model.Metric, len(m.Labels()))
+			for _, l := range m.Labels() {
+				metric[model.LabelName(l.Name)] = model.LabelValue(l.Value)
+			}
+			seen[metric.String()] = metric
+		}
+		if set.Err() != nil {
+			respondError(w, http.StatusUnprocessableEntity, "exec", set.Err().Error())
+			return
+		}
+	}
+
+	keys := make([]string, 0, len(seen))
+	for k := range seen {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	result := make([]model.Metric, 0, len(keys))
+	for _, k := range keys {
+		result = append(result, seen[k])
+	}
+	respondSuccess(w, result)
+}
+
+func (a *API) handleLabels(w http.ResponseWriter, r *http.Request) {
+	lq, ok := a.queryable.backend.(backend.LabelQuerier)
+	if !ok {
+		respondSuccess(w, []string{})
+		return
+	}
+	start, end := requestTimeRangeOrDefault(r)
+	names, err := lq.LabelNames(r.Context(), start, end)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "internal", err.Error())
+		return
+	}
+	respondSuccess(w, names)
+}
+
+func (a *API) handleLabelValues(w http.ResponseWriter, r *http.Request) {
+	lq, ok := a.queryable.backend.(backend.LabelQuerier)
+	if !ok {
+		respondSuccess(w, []string{})
+		return
+	}
+	name := route.Param(r.Context(), "name")
+	start, end := requestTimeRangeOrDefault(r)
+	values, err := lq.LabelValues(r.Context(), name, start, end)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "internal", err.Error())
+		return
+	}
+	respondSuccess(w, values)
+}
+
+func requestTimeRangeOrDefault(r *http.Request) (startMs, endMs int64) {
+	start, err := parseTimeParam(r.FormValue("start"), time.Now().Add(-24*time.Hour))
+	if err != nil {
+		start = time.Now().Add(-24 * time.Hour)
+	}
+	end, err := parseTimeParam(r.FormValue("end"), time.Now())
+	if err != nil {
+		end = time.Now()
+	}
+	return timeToMs(start), timeToMs(end)
+}
+
+func timeToMs(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func parseTimeParam(v string, def time.Time) (time.Time, error) {
+	if v == "" {
+		return def, nil
+	}
+	if f, err := strconv.ParseFloat(v, 64); err == nil {
+		s := int64(f)
+		ns := int64((f - float64(s)) * float64(time.Second))
+		return time.Unix(s, ns).UTC(), nil
+	}
+	return time.Parse(time.RFC3339Nano, v)
+}
+
+func parseDuration(v string) (time.Duration, error) {
+	if v == "" {
+		return 0, nil
+	}
+	if f, err := strconv.ParseFloat(v, 64); err == nil {
+		return time.Duration(f * float64(time.Second)), nil
+	}
+	d, err := model.ParseDuration(v)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(d), nil
+}
+
+func parseMatchParams(raw []string) ([][]*labels.Matcher, error) {
+	sets := make([][]*labels.Matcher, 0, len(raw))
+	for _, s := range raw {
+		matchers, err := promql.ParseMetricSelector(s)
+		if err != nil {
+			return nil, err
+		}
+		sets = append(sets, matchers)
+	}
+	return sets, nil
+}
@@ -0,0 +1,66 @@
+package queryapi
+
+import (
+	"context"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/storage/remote"
+
+	"github.com/jodok/crate_adapter/pkg/backend"
+)
+
+// queryable adapts a backend.Backend to storage.Queryable so it can be
+// wired into a promql.Engine.
+type queryable struct {
+	backend backend.Backend
+}
+
+func (q *queryable) Querier(ctx context.Context, mint, maxt int64) (storage.Querier, error) {
+	return &querier{ctx: ctx, backend: q.backend, mint: mint, maxt: maxt}, nil
+}
+
+type querier struct {
+	ctx        context.Context
+	backend    backend.Backend
+	mint, maxt int64
+}
+
+// Select implements storage.Querier by translating matchers (and, if
+// present, range/step hints) into a single prompb.Query and delegating to
+// the backend, reusing the same wire-format conversion helpers the remote
+// read/write protocol uses.
+func (q *querier) Select(sortSeries bool, hints *storage.SelectHints, matchers ...*labels.Matcher) storage.SeriesSet {
+	pbQuery, err := remote.ToQuery(q.mint, q.maxt, matchers, hints)
+	if err != nil {
+		return storage.ErrSeriesSet(err)
+	}
+	series, err := q.backend.Read(q.ctx, pbQuery)
+	if err != nil {
+		return storage.ErrSeriesSet(err)
+	}
+	return remote.FromQueryResult(sortSeries, &prompb.QueryResult{Timeseries: series})
+}
+
+func (q *querier) LabelValues(name string) ([]string, storage.Warnings, error) {
+	lq, ok := q.backend.(backend.LabelQuerier)
+	if !ok {
+		return nil, nil, nil
+	}
+	values, err := lq.LabelValues(q.ctx, name, q.mint, q.maxt)
+	return values, nil, err
+}
+
+func (q *querier) LabelNames() ([]string, storage.Warnings, error) {
+	lq, ok := q.backend.(backend.LabelQuerier)
+	if !ok {
+		return nil, nil, nil
+	}
+	names, err := lq.LabelNames(q.ctx, q.mint, q.maxt)
+	return names, nil, err
+}
+
+func (q *querier) Close() error {
+	return nil
+}
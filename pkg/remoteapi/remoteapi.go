@@ -0,0 +1,427 @@
+// Package remoteapi implements the Prometheus remote read/write HTTP
+// protocol on top of a pluggable backend.Backend, independent of how that
+// backend stores data.
+package remoteapi
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+
+	"github.com/jodok/crate_adapter/pkg/backend"
+)
+
+var (
+	writeDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: "crate_adapter_write_latency_seconds",
+		Help: "How long it took us to respond to write requests.",
+	})
+	writeErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "crate_adapter_write_failed_total",
+		Help: "How many write request we returned errors for.",
+	})
+	writeSamples = prometheus.NewSummary(prometheus.SummaryOpts{
+		Name: "crate_adapter_write_timeseries_samples",
+		Help: "How many samples each written timeseries has.",
+	})
+	readDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: "crate_adapter_read_latency_seconds",
+		Help: "How long it took us to respond to read requests.",
+	})
+	readErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "crate_adapter_read_failed_total",
+		Help: "How many read requests we returned errors for.",
+	})
+	readSamples = prometheus.NewSummary(prometheus.SummaryOpts{
+		Name: "crate_adapter_read_timeseries_samples",
+		Help: "How many samples each returned timeseries has.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(writeDuration)
+	prometheus.MustRegister(writeErrors)
+	prometheus.MustRegister(writeSamples)
+	prometheus.MustRegister(readDuration)
+	prometheus.MustRegister(readErrors)
+	prometheus.MustRegister(readSamples)
+}
+
+// streamPageSize is how many rows a RangePager is asked for per round trip
+// while serving a STREAMED_XOR_CHUNKS read.
+const streamPageSize = 5000
+
+// samplesPerChunk is the target number of samples per XOR chunk, matching
+// the bucket size Prometheus itself uses for in-memory chunks.
+const samplesPerChunk = 120
+
+// Server serves the Prometheus remote read/write HTTP endpoints on top of
+// a Backend.
+type Server struct {
+	Backend backend.Backend
+}
+
+// NewServer returns a Server reading from and writing to b.
+func NewServer(b backend.Backend) *Server {
+	return &Server{Backend: b}
+}
+
+// HandleWrite serves a Prometheus remote-write request.
+func (s *Server) HandleWrite(w http.ResponseWriter, r *http.Request) {
+	timer := prometheus.NewTimer(writeDuration)
+	defer timer.ObserveDuration()
+
+	req, err := decodeWriteRequest(r)
+	if err != nil {
+		log.With("err", err).Error("Failed to decode write request.")
+		writeErrors.Inc()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	for _, ts := range req.Timeseries {
+		writeSamples.Observe(float64(len(ts.Samples)))
+	}
+
+	if err := s.Backend.Write(r.Context(), req); err != nil {
+		log.With("err", err).Error("Failed to write to backend.")
+		writeErrors.Inc()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func decodeWriteRequest(r *http.Request) (*prompb.WriteRequest, error) {
+	compressed, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	reqBuf, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return nil, err
+	}
+	var req prompb.WriteRequest
+	if err := proto.Unmarshal(reqBuf, &req); err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+// HandleRead serves a Prometheus remote-read request, either as one
+// buffered protobuf response or, if the client offered
+// STREAMED_XOR_CHUNKS, as a series of framed chunked responses.
+func (s *Server) HandleRead(w http.ResponseWriter, r *http.Request) {
+	timer := prometheus.NewTimer(readDuration)
+	defer timer.ObserveDuration()
+
+	req, err := decodeReadRequest(r)
+	if err != nil {
+		log.With("err", err).Error("Failed to decode read request.")
+		readErrors.Inc()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if wantsStreamedChunks(req) {
+		if err := s.handleStreamedRead(w, r, req); err != nil {
+			log.With("err", err).Error("Failed to stream chunked read response.")
+			readErrors.Inc()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	results, err := s.runQueries(r, req.Queries)
+	if err != nil {
+		log.With("err", err).Error("Failed to run read queries against backend.")
+		readErrors.Inc()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp := prompb.ReadResponse{Results: results}
+	data, err := proto.Marshal(&resp)
+	if err != nil {
+		log.With("err", err).Error("Failed to marshal response.")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	if _, err := w.Write(snappy.Encode(nil, data)); err != nil {
+		log.With("err", err).Error("Failed to compress response.")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func decodeReadRequest(r *http.Request) (*prompb.ReadRequest, error) {
+	compressed, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	reqBuf, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return nil, err
+	}
+	var req prompb.ReadRequest
+	if err := proto.Unmarshal(reqBuf, &req); err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+// runQueries runs every query in qs against the backend concurrently and
+// returns one QueryResult per query, in the same order as qs.
+func (s *Server) runQueries(r *http.Request, qs []*prompb.Query) ([]*prompb.QueryResult, error) {
+	results := make([]*prompb.QueryResult, len(qs))
+	errs := make([]error, len(qs))
+
+	var wg sync.WaitGroup
+	for i, q := range qs {
+		wg.Add(1)
+		go func(i int, q *prompb.Query) {
+			defer wg.Done()
+			series, err := s.Backend.Read(r.Context(), q)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			for _, ts := range series {
+				readSamples.Observe(float64(len(ts.Samples)))
+			}
+			results[i] = &prompb.QueryResult{Timeseries: series}
+		}(i, q)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// wantsStreamedChunks reports whether the client offered to accept the
+// newer STREAMED_XOR_CHUNKS response type.
+func wantsStreamedChunks(req *prompb.ReadRequest) bool {
+	for _, t := range req.AcceptedResponseTypes {
+		if t == prompb.ReadRequest_STREAMED_XOR_CHUNKS {
+			return true
+		}
+	}
+	return false
+}
+
+// handleStreamedRead serves req as a series of framed, snappy-compressed
+// ChunkedReadResponse messages. If the backend supports backend.RangePager
+// it is used to page rows in, keeping memory use bounded; otherwise the
+// query is answered via Read and chunked up from the full result.
+func (s *Server) handleStreamedRead(w http.ResponseWriter, r *http.Request, req *prompb.ReadRequest) error {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return fmt.Errorf("streaming unsupported by response writer")
+	}
+	w.Header().Set("Content-Type", "application/x-streamed-protobuf; proto=prometheus.ChunkedReadResponse")
+
+	pager, _ := s.Backend.(backend.RangePager)
+	for i, q := range req.Queries {
+		var err error
+		if pager != nil {
+			err = s.streamQueryChunksPaged(r, w, flusher, pager, q, int64(i))
+		} else {
+			err = s.streamQueryChunksBuffered(r, w, flusher, q, int64(i))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// streamQueryChunksBuffered materializes q via Backend.Read and then
+// chunk-encodes the result, for backends that don't implement RangePager.
+func (s *Server) streamQueryChunksBuffered(r *http.Request, w http.ResponseWriter, flusher http.Flusher, q *prompb.Query, queryIndex int64) error {
+	series, err := s.Backend.Read(r.Context(), q)
+	if err != nil {
+		return err
+	}
+	for _, ts := range series {
+		if err := writeSeriesChunks(w, flusher, queryIndex, ts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// streamQueryChunksPaged walks q page by page via pager, encoding and
+// flushing each series' chunk as soon as it fills, so a large range never
+// needs to be buffered in full on either side of the HTTP request.
+func (s *Server) streamQueryChunksPaged(r *http.Request, w http.ResponseWriter, flusher http.Flusher, pager backend.RangePager, q *prompb.Query, queryIndex int64) error {
+	builders := map[string]*seriesChunkBuilder{}
+	var order []string
+
+	cursor := q.StartTimestampMs - 1
+	for {
+		page, last, err := pager.ReadPage(r.Context(), q, cursor, streamPageSize)
+		if err != nil {
+			return err
+		}
+		if last == cursor {
+			break
+		}
+		cursor = last
+
+		for _, ts := range page {
+			key := seriesKey(ts)
+			b, ok := builders[key]
+			if !ok {
+				b = &seriesChunkBuilder{labels: ts.Labels}
+				builders[key] = b
+				order = append(order, key)
+			}
+			for _, sample := range ts.Samples {
+				b.append(sample.Timestamp, sample.Value)
+				if b.full() {
+					if err := writeChunkedResponse(w, flusher, queryIndex, b.flush()); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+
+	for _, key := range order {
+		if series, ok := builders[key].finish(); ok {
+			if err := writeChunkedResponse(w, flusher, queryIndex, series); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func seriesKey(ts *prompb.TimeSeries) string {
+	names := make([]string, 0, len(ts.Labels))
+	values := map[string]string{}
+	for _, l := range ts.Labels {
+		names = append(names, l.Name)
+		values[l.Name] = l.Value
+	}
+	sort.Strings(names)
+	parts := make([]string, 0, len(names))
+	for _, n := range names {
+		parts = append(parts, n+"="+values[n])
+	}
+	return strings.Join(parts, ",")
+}
+
+// writeSeriesChunks splits an already-materialized series into
+// samplesPerChunk-sized XOR chunks and writes each as its own frame.
+func writeSeriesChunks(w http.ResponseWriter, flusher http.Flusher, queryIndex int64, ts *prompb.TimeSeries) error {
+	b := &seriesChunkBuilder{labels: ts.Labels}
+	for _, sample := range ts.Samples {
+		b.append(sample.Timestamp, sample.Value)
+		if b.full() {
+			if err := writeChunkedResponse(w, flusher, queryIndex, b.flush()); err != nil {
+				return err
+			}
+		}
+	}
+	if series, ok := b.finish(); ok {
+		return writeChunkedResponse(w, flusher, queryIndex, series)
+	}
+	return nil
+}
+
+// seriesChunkBuilder accumulates samples for a single series into a
+// Gorilla/XOR-encoded chunk, emitting it once it reaches samplesPerChunk.
+type seriesChunkBuilder struct {
+	labels []prompb.Label
+
+	chunk    chunkenc.Chunk
+	appender chunkenc.Appender
+	count    int
+	minT     int64
+	maxT     int64
+}
+
+func (b *seriesChunkBuilder) append(t int64, v float64) {
+	if b.chunk == nil {
+		b.chunk = chunkenc.NewXORChunk()
+		app, _ := b.chunk.Appender()
+		b.appender = app
+		b.minT = t
+	}
+	b.appender.Append(t, v)
+	b.count++
+	b.maxT = t
+}
+
+func (b *seriesChunkBuilder) full() bool {
+	return b.count >= samplesPerChunk
+}
+
+// flush returns the current chunk as a ChunkedSeries and resets the
+// builder so the next samples start a fresh chunk.
+func (b *seriesChunkBuilder) flush() *prompb.ChunkedSeries {
+	series := &prompb.ChunkedSeries{
+		Labels: b.labels,
+		Chunks: []prompb.Chunk{{
+			Type:      prompb.Chunk_XOR,
+			MinTimeMs: b.minT,
+			MaxTimeMs: b.maxT,
+			Data:      b.chunk.Bytes(),
+		}},
+	}
+	b.chunk = nil
+	b.appender = nil
+	b.count = 0
+	return series
+}
+
+// finish returns any partially-filled chunk remaining once a query is done,
+// or ok=false if the builder never saw a sample.
+func (b *seriesChunkBuilder) finish() (*prompb.ChunkedSeries, bool) {
+	if b.chunk == nil {
+		return nil, false
+	}
+	return b.flush(), true
+}
+
+// writeChunkedResponse writes series as a single ChunkedReadResponse frame:
+// a varint-encoded length followed by a snappy-compressed protobuf message.
+func writeChunkedResponse(w http.ResponseWriter, flusher http.Flusher, queryIndex int64, series *prompb.ChunkedSeries) error {
+	resp := &prompb.ChunkedReadResponse{
+		ChunkedSeries: []*prompb.ChunkedSeries{series},
+		QueryIndex:    queryIndex,
+	}
+	data, err := proto.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	compressed := snappy.Encode(nil, data)
+
+	var lenBuf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(lenBuf[:], uint64(len(compressed)))
+	if _, err := w.Write(lenBuf[:n]); err != nil {
+		return err
+	}
+	if _, err := w.Write(compressed); err != nil {
+		return err
+	}
+	flusher.Flush()
+	return nil
+}